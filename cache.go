@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/template"
+	"text/template/parse"
+)
+
+// cacheEntry records what a source path hashed to the last time it was
+// built, and which output file(s) it produced.
+type cacheEntry struct {
+	Hash    string   `json:"hash"`
+	Outputs []string `json:"outputs,omitempty"`
+}
+
+// buildCache is the in-memory form of .jkl-cache/manifest.json: a map
+// from a tracked key ("page:" plus a page's output path, "layout:" plus a
+// layout's template name, "static:" plus a static file's relative path,
+// or "site:posts" for the post list) to what it last hashed to. It lets
+// Site.Generate skip rewriting outputs whose sources haven't changed.
+type buildCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]cacheEntry
+	touched map[string]bool // keys recorded during the current build
+}
+
+func cachePath(src string) string {
+	return filepath.Join(src, ".jkl-cache", "manifest.json")
+}
+
+// loadBuildCache reads the manifest for src, returning an empty cache if
+// none exists yet or it can't be parsed.
+func loadBuildCache(src string) *buildCache {
+	c := &buildCache{path: cachePath(src), entries: map[string]cacheEntry{}, touched: map[string]bool{}}
+
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return c
+	}
+	json.Unmarshal(data, &c.entries)
+	return c
+}
+
+// save persists the cache to disk.
+func (c *buildCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path, data, 0644)
+}
+
+// hash returns the hash recorded for key on the previous build, or "" if
+// key was never recorded.
+func (c *buildCache) hash(key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[key].Hash
+}
+
+// record stores the hash (and, if given, the output files produced) for
+// key in this build.
+func (c *buildCache) record(key, hash string, outputs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.touched[key] = true
+	c.entries[key] = cacheEntry{Hash: hash, Outputs: outputs}
+}
+
+// pruneStale deletes the output files recorded against any entry that
+// wasn't touched during this build - i.e. a page, post, or static file
+// that was renamed or removed since the last build - then drops those
+// entries so they aren't considered again, and resets the touched set for
+// the next build. dest is the site's destination root that Outputs are
+// relative to.
+func (c *buildCache) pruneStale(dest string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if c.touched[key] {
+			continue
+		}
+		for _, out := range entry.Outputs {
+			if err := os.Remove(filepath.Join(dest, out)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			logf(MsgRemoveFile, out)
+		}
+		delete(c.entries, key)
+	}
+
+	c.touched = map[string]bool{}
+	return nil
+}
+
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hashString(s string) string {
+	return hashBytes([]byte(s))
+}
+
+// templateRefs maps each parsed template's name to the names of the
+// templates it directly references via {{template "x"}} or {{block "x"}},
+// found by walking its parsed syntax tree. text/template compiles
+// {{block}} down to a define plus a TemplateNode, so no separate case is
+// needed for it.
+func templateRefs(t *template.Template) map[string][]string {
+	refs := map[string][]string{}
+	if t == nil {
+		return refs
+	}
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree == nil {
+			continue
+		}
+		refs[tmpl.Name()] = walkTemplateRefs(tmpl.Tree.Root, nil)
+	}
+	return refs
+}
+
+func walkTemplateRefs(node parse.Node, refs []string) []string {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return refs
+		}
+		for _, c := range n.Nodes {
+			refs = walkTemplateRefs(c, refs)
+		}
+	case *parse.TemplateNode:
+		refs = append(refs, n.Name)
+	case *parse.IfNode:
+		refs = walkTemplateRefs(n.List, refs)
+		refs = walkTemplateRefs(n.ElseList, refs)
+	case *parse.RangeNode:
+		refs = walkTemplateRefs(n.List, refs)
+		refs = walkTemplateRefs(n.ElseList, refs)
+	case *parse.WithNode:
+		refs = walkTemplateRefs(n.List, refs)
+		refs = walkTemplateRefs(n.ElseList, refs)
+	}
+	return refs
+}
+
+// transitiveTemplateRefs returns every template name reachable from name
+// by following the direct references in refs.
+func transitiveTemplateRefs(refs map[string][]string, name string) []string {
+	seen := map[string]bool{}
+	var walk func(string)
+	walk = func(n string) {
+		for _, dep := range refs[n] {
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			walk(dep)
+		}
+	}
+	walk(name)
+
+	out := make([]string, 0, len(seen))
+	for n := range seen {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -1,74 +1,257 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
 	"launchpad.net/goyaml"
 )
 
-// Config represents the key-value pairs in a _config.yaml file.
-// The file is freeform, and thus requires the flexibility of a map.
-type Config map[string]interface{}
+// Config is a layered key-value store backing both _config.yaml and
+// runtime site data. A lookup checks each layer in precedence order and
+// returns the first hit:
+//
+//  1. overrides  - values set explicitly with Set(), which in practice
+//     means CLI flags (main.go pushes flag values in with
+//     Set) as well as computed site data (posts, tags, ...)
+//  2. env        - environment variables named JKL_<KEY>
+//  3. file       - the parsed _config.yaml (merged with an -env overlay)
+//  4. defaults   - built-in defaults seeded with SetDefault()
+//
+// The zero Config is not usable; use NewConfig or LoadConfig.
+type Config struct {
+	overrides map[string]interface{}
+	file      map[string]interface{}
+	defaults  map[string]interface{}
+	prefix    string // dotted path this Config was Sub'd from, e.g. "deploy"
+}
+
+// NewConfig returns an empty, ready to use Config.
+func NewConfig() Config {
+	return Config{
+		overrides: map[string]interface{}{},
+		file:      map[string]interface{}{},
+		defaults:  map[string]interface{}{},
+	}
+}
 
-// Sets a parameter value.
+// Sets a parameter value. This is the highest-precedence layer, used both
+// for CLI flag overrides and for injecting computed site data (posts,
+// tags, categories, ...) that templates read back out via site.*.
 func (c Config) Set(key string, val interface{}) {
-	c[key] = val
+	c.overrides[key] = val
 }
 
-// Gets a parameter value.
+// SetDefault seeds the lowest-precedence layer, used at startup to fill
+// in values the user hasn't set anywhere else.
+func (c Config) SetDefault(key string, val interface{}) {
+	c.defaults[key] = val
+}
+
+// Gets a parameter value, checking overrides, then JKL_<KEY> in the
+// environment, then the parsed config file(s), then defaults.
 func (c Config) Get(key string) interface{} {
-	return c[key]
+	if v, ok := c.overrides[key]; ok {
+		return v
+	}
+	if v, ok := os.LookupEnv(envKey(c.qualify(key))); ok {
+		return v
+	}
+	if v, ok := c.file[key]; ok {
+		return v
+	}
+	if v, ok := c.defaults[key]; ok {
+		return v
+	}
+	return nil
+}
+
+// qualify prepends the dotted path this Config was Sub'd from, if any, so
+// a key looked up on a sub-config resolves the same env var its full
+// dotted name would, e.g. "bucket" on Sub("deploy") becomes "deploy.bucket".
+func (c Config) qualify(key string) string {
+	if c.prefix == "" {
+		return key
+	}
+	return c.prefix + "." + key
+}
+
+// envKey maps a config key to the environment variable that overrides it,
+// e.g. "deploy.bucket" -> "JKL_DEPLOY_BUCKET".
+func envKey(key string) string {
+	return "JKL_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
 }
 
 // Gets a parameter value as a string. If none exists return an empty string.
 func (c Config) GetString(key string) (str string) {
-	if v, ok := c[key]; ok {
-		str = v.(string)
+	switch v := c.Get(key).(type) {
+	case nil:
+	case string:
+		str = v
+	default:
+		str = fmt.Sprintf("%v", v)
+	}
+	return
+}
+
+// Gets a parameter value as a bool. If none exists return false.
+func (c Config) GetBool(key string) (b bool) {
+	switch v := c.Get(key).(type) {
+	case bool:
+		b = v
+	case string:
+		b, _ = strconv.ParseBool(v)
+	}
+	return
+}
+
+// Gets a parameter value as an int. If none exists return 0.
+func (c Config) GetInt(key string) (i int) {
+	switch v := c.Get(key).(type) {
+	case int:
+		i = v
+	case int64:
+		i = int(v)
+	case float64:
+		i = int(v)
+	case string:
+		i, _ = strconv.Atoi(v)
 	}
 	return
 }
 
-// ParseConfig will parse a YAML file at the given path and return
-// a key-value Config structure.
+// Gets a parameter value as a time.Duration. Strings are parsed with
+// time.ParseDuration (e.g. "30s"); a bare int is treated as a count of
+// seconds.
+func (c Config) GetDuration(key string) (d time.Duration) {
+	switch v := c.Get(key).(type) {
+	case time.Duration:
+		d = v
+	case string:
+		d, _ = time.ParseDuration(v)
+	case int:
+		d = time.Duration(v) * time.Second
+	}
+	return
+}
+
+// Gets a parameter value as a slice of strings. A YAML list comes back as
+// []interface{}; a bare string is split on commas.
+func (c Config) GetStringSlice(key string) []string {
+	switch v := c.Get(key).(type) {
+	case []string:
+		return v
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	case string:
+		if v == "" {
+			return nil
+		}
+		return strings.Split(v, ",")
+	}
+	return nil
+}
+
+// Sub returns a nested block (e.g. the `deploy:` table in _config.yaml)
+// as its own Config. Returns an empty Config if key is absent or isn't a
+// map. Env var lookups on the result are qualified by key (and any prefix
+// c itself carries), so Sub("deploy").Get("bucket") still resolves
+// JKL_DEPLOY_BUCKET.
+func (c Config) Sub(key string) Config {
+	sub := NewConfig()
+	sub.prefix = c.qualify(key)
+	switch v := c.Get(key).(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			sub.file[k] = val
+		}
+	case map[interface{}]interface{}:
+		for k, val := range v {
+			if ks, ok := k.(string); ok {
+				sub.file[ks] = val
+			}
+		}
+	}
+	return sub
+}
+
+// Map flattens the layers (lowest precedence first, so higher layers
+// win) into a single map. This is what gets handed to templates as
+// site.*; env vars are excluded since there's no fixed set of keys to
+// enumerate there.
+func (c Config) Map() map[string]interface{} {
+	m := make(map[string]interface{}, len(c.defaults)+len(c.file)+len(c.overrides))
+	for k, v := range c.defaults {
+		m[k] = v
+	}
+	for k, v := range c.file {
+		m[k] = v
+	}
+	for k, v := range c.overrides {
+		m[k] = v
+	}
+	return m
+}
+
+// LoadConfig reads _config.yaml from dir and, if env is non-empty,
+// merges _config.<env>.yaml over it (e.g. -env=production loads
+// _config.production.yaml on top of _config.yaml). The merge is by
+// top-level key only: a nested block such as deploy: in the overlay
+// replaces the base file's block as a whole. Built-in defaults are
+// seeded before the file is parsed.
 //
-// ParseConfig always returns a non-nil map containing all the
-// valid YAML parameters found; err describes the first unmarshalling
-// error encountered, if any.
-func ParseConfig(path string) (Config, error) {
-	data, err := ioutil.ReadFile(path)
+// contentdir/layoutdir/staticdir/publishdir/builddrafts are not seeded,
+// as nothing reads them back - the directory layout is fixed by the
+// (unexported) file-type predicates, and the destination directory by
+// NewSite's "dest" check and the -destination flag.
+func LoadConfig(dir, env string) (Config, error) {
+	conf := NewConfig()
+	conf.SetDefault("uglyurls", false)
+
+	base := filepath.Join(dir, "_config.yaml")
+	data, err := parseYAMLFile(base)
 	if err != nil {
-		return nil, err
+		return conf, err
+	}
+	logf(MsgUsingConfig, base)
+	for k, v := range data {
+		conf.file[k] = v
 	}
 
-	conf := map[string]interface{}{}
-	err = goyaml.Unmarshal(data, &conf)
-	if err != nil {
-		return nil, err
+	if env != "" {
+		overlay := filepath.Join(dir, fmt.Sprintf("_config.%s.yaml", env))
+		if data, err := parseYAMLFile(overlay); err == nil {
+			logf(MsgUsingConfig, overlay)
+			for k, v := range data {
+				conf.file[k] = v
+			}
+		}
 	}
 
 	return conf, nil
 }
 
-// DeployConfig represents the key-value data in the _jekyll_s3.yaml file
-// used for deploying a website to Amazon's S3.
-type DeployConfig struct {
-	Key    string `s3_id:""`
-	Secret string `s3_secret:""`
-	Bucket string `s3_bucket:""`
-}
-
-// ParseDeployConfig will parse a YAML file at the given path and return
-// a key-value DeployConfig structure.
-func ParseDeployConfig(path string) (*DeployConfig, error) {
+// parseYAMLFile parses a YAML file into a plain map.
+func parseYAMLFile(path string) (map[string]interface{}, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	conf := DeployConfig{}
-	err = goyaml.Unmarshal(data, &conf)
-	if err != nil {
+	m := map[string]interface{}{}
+	if err := goyaml.Unmarshal(data, &m); err != nil {
 		return nil, err
 	}
-
-	return &conf, nil
+	return m, nil
 }
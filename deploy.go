@@ -0,0 +1,325 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"launchpad.net/goamz/aws"
+	"launchpad.net/goamz/s3"
+)
+
+// Deployer publishes the contents of a generated site, rooted at root,
+// to some hosting target.
+type Deployer interface {
+	Deploy(ctx context.Context, root string) error
+}
+
+// NewDeployer returns the Deployer named by name, configured from the
+// deploy: block in conf. If name is empty, the provider: key of that
+// block is used instead. jobs caps how many files a deployer that
+// supports concurrent uploads (currently S3Deployer) will send at once.
+func NewDeployer(conf Config, name string, jobs int) (Deployer, error) {
+	block := conf.Sub("deploy")
+	if name == "" {
+		name = block.GetString("provider")
+	}
+
+	switch name {
+	case "s3":
+		return &S3Deployer{
+			Key:    block.GetString("key"),
+			Secret: block.GetString("secret"),
+			Bucket: block.GetString("bucket"),
+			Jobs:   jobs,
+		}, nil
+
+	case "netlify":
+		return &NetlifyDeployer{
+			Site:  block.GetString("site"),
+			Token: block.GetString("token"),
+		}, nil
+
+	case "rsync":
+		return &RsyncDeployer{
+			Target: block.GetString("target"),
+		}, nil
+
+	case "gh-pages":
+		return &GitPagesDeployer{
+			Remote: block.GetString("remote"),
+			Branch: block.GetString("branch"),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown deploy provider: %q", name)
+	}
+}
+
+// manifest maps a file path, relative to the deployed root, to the sha256
+// of its contents. It is persisted per deploy target so a re-deploy can
+// skip files that haven't changed.
+type manifest map[string]string
+
+// manifestPath returns the path of the on-disk manifest for the named
+// deploy target, stored alongside the generated site.
+func manifestPath(root, target string) string {
+	return filepath.Join(root, fmt.Sprintf(".jkl-manifest.%s.json", target))
+}
+
+func loadManifest(path string) manifest {
+	m := manifest{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return m
+	}
+	json.Unmarshal(data, &m)
+	return m
+}
+
+func saveManifest(path string, m manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// manifestGlob matches the per-target deploy manifests written by
+// manifestPath, so every deployer can exclude its own (and every other
+// target's) bookkeeping file from what actually gets published.
+const manifestGlob = ".jkl-manifest.*.json"
+
+// isManifestFile reports whether path is one of those manifests.
+func isManifestFile(path string) bool {
+	ok, _ := filepath.Match(manifestGlob, filepath.Base(path))
+	return ok
+}
+
+func hashFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// S3Deployer uploads a site to an Amazon S3 bucket, the original jkl
+// deploy target.
+type S3Deployer struct {
+	Key    string
+	Secret string
+	Bucket string
+	Jobs   int // max files uploaded concurrently; defaults to 1
+}
+
+func (d *S3Deployer) Deploy(ctx context.Context, root string) error {
+	auth := aws.Auth{AccessKey: d.Key, SecretKey: d.Secret}
+	b := s3.New(auth, aws.USEast).Bucket(d.Bucket)
+
+	path := manifestPath(root, "s3")
+	prev := loadManifest(path)
+
+	var files []string
+	walker := func(fn string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || isManifestFile(fn) {
+			return err
+		}
+		files = append(files, fn)
+		return nil
+	}
+	if err := filepath.Walk(root, walker); err != nil {
+		return err
+	}
+
+	jobs := d.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := make(chan struct{}, jobs)
+
+	var mu sync.Mutex
+	next := manifest{}
+
+	g, ctx := errgroup.WithContext(ctx)
+	for _, fn := range files {
+		fn := fn
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			rel, _ := filepath.Rel(root, fn)
+			sum, err := hashFile(fn)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			next[rel] = sum
+			mu.Unlock()
+
+			// Skip the upload if the file hasn't changed since the last deploy.
+			if prev[rel] == sum {
+				return nil
+			}
+
+			typ := mime.TypeByExtension(filepath.Ext(rel))
+			content, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return err
+			}
+			logf(MsgUploadFile, rel)
+
+			// try to upload the file ... sometimes this fails due to amazon
+			// issues. If so, we'll re-try
+			if err := b.Put(rel, content, typ, s3.PublicRead); err != nil {
+				time.Sleep(100 * time.Millisecond) // sleep so that we don't immediately retry
+				return b.Put(rel, content, typ, s3.PublicRead)
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	return saveManifest(path, next)
+}
+
+// NetlifyDeployer zips the generated site and POSTs it to Netlify's
+// deploy API.
+type NetlifyDeployer struct {
+	Site  string // Netlify site ID
+	Token string // personal access token
+}
+
+func (d *NetlifyDeployer) Deploy(ctx context.Context, root string) error {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	walker := func(fn string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || isManifestFile(fn) {
+			return err
+		}
+		rel, _ := filepath.Rel(root, fn)
+		logf(MsgUploadFile, rel)
+
+		w, err := zw.Create(rel)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(content)
+		return err
+	}
+	if err := filepath.Walk(root, walker); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("https://api.netlify.com/api/v1/sites/%s/deploys", d.Site)
+	req, err := http.NewRequest("POST", url, &buf)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/zip")
+	req.Header.Set("Authorization", "Bearer "+d.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("netlify deploy failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// RsyncDeployer mirrors the generated site to a remote path with rsync,
+// e.g. "user@host:/var/www/site". rsync does its own diffing, so no
+// manifest is needed here.
+type RsyncDeployer struct {
+	Target string
+}
+
+func (d *RsyncDeployer) Deploy(ctx context.Context, root string) error {
+	src := root
+	if !strings.HasSuffix(src, string(os.PathSeparator)) {
+		src += string(os.PathSeparator)
+	}
+
+	// Manifests left behind by other deployers (e.g. s3, netlify) live
+	// inside root; don't mirror them to the rsync target.
+	cmd := exec.CommandContext(ctx, "rsync", "-az", "--delete", "--exclude="+manifestGlob, src, d.Target)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// GitPagesDeployer commits the generated site to a branch (gh-pages by
+// default) and pushes it to a remote.
+type GitPagesDeployer struct {
+	Remote string // defaults to "origin"
+	Branch string // defaults to "gh-pages"
+}
+
+func (d *GitPagesDeployer) Deploy(ctx context.Context, root string) error {
+	remote := d.Remote
+	if remote == "" {
+		remote = "origin"
+	}
+	branch := d.Branch
+	if branch == "" {
+		branch = "gh-pages"
+	}
+
+	run := func(args ...string) error {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = root
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+
+	if _, err := os.Stat(filepath.Join(root, ".git")); os.IsNotExist(err) {
+		if err := run("init"); err != nil {
+			return err
+		}
+	}
+	if err := run("checkout", "-B", branch); err != nil {
+		return err
+	}
+	// Manifests left behind by other deployers (e.g. s3, netlify) live
+	// inside root; don't commit them to the gh-pages branch.
+	if err := run("add", "-A", "--", ".", ":(exclude)"+manifestGlob); err != nil {
+		return err
+	}
+	if err := run("commit", "-m", "jkl site deploy", "--allow-empty"); err != nil {
+		return err
+	}
+	return run("push", "-f", remote, branch)
+}
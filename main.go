@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/howeyc/fsnotify"
 )
@@ -20,10 +25,11 @@ var (
 	destination = flag.String("destination", "_site", "directory where jkl will write files to")
 	server      = flag.Bool("server", false, "fires up a server that will host your _site directory if True")
 	port        = flag.String("server_port", ":4000", "the port that the jkl server will run on")
-	deploy      = flag.Bool("s3", false, "deploys the website to S3")
-	s3key       = flag.String("s3_key", "", "s3 access key")
-	s3secret    = flag.String("s3_secret", "", "s3 secret key")
-	s3bucket    = flag.String("s3_bucket", "", "s3 bucket name")
+	deployTo    = flag.String("deploy", "", "deploys the website using the named target (s3, netlify, rsync, gh-pages), overriding the provider: key of the deploy: block in _config.yaml")
+	jobs        = flag.Int("jobs", runtime.NumCPU(), "number of pages, static files, or uploads processed concurrently")
+	uglyurls    = flag.Bool("uglyurls", false, "writes pages to their raw URL (e.g. about.html) instead of pretty URLs (about/index.html)")
+	env         = flag.String("env", "", "environment name; merges _config.<env>.yaml over _config.yaml")
+	force       = flag.Bool("force", false, "ignores the .jkl-cache build cache and rewrites every output file")
 	verbose     = flag.Bool("verbose", false, "runs jkl with verbose output if True")
 
 	// Chnge the default output of the -help flag.
@@ -45,6 +51,136 @@ var (
 // Mutex used when doing auto-builds
 var mu sync.RWMutex
 
+// reloads broadcasts to every connected browser when an -auto rebuild
+// finishes, so the live-reload script can trigger a refresh.
+var reloads = newReloadBroadcaster()
+
+// liveReloadScript is injected into every text/html response in -auto mode.
+// It opens an SSE connection and reloads the page when the server notifies
+// it that the site was recompiled.
+const liveReloadScript = `<script>(function(){
+	var source = new EventSource("/_jkl/reload");
+	source.addEventListener("reload", function() { location.reload(); });
+	source.onerror = function() { source.close(); };
+})();</script>`
+
+// reloadBroadcaster keeps a set of subscriber channels, one per connected
+// browser, and fans out a reload notification to all of them.
+type reloadBroadcaster struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]bool
+}
+
+func newReloadBroadcaster() *reloadBroadcaster {
+	return &reloadBroadcaster{subs: map[chan struct{}]bool{}}
+}
+
+func (b *reloadBroadcaster) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	b.subs[ch] = true
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *reloadBroadcaster) unsubscribe(ch chan struct{}) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+	close(ch)
+}
+
+func (b *reloadBroadcaster) broadcast() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// already has a pending reload queued
+		}
+	}
+}
+
+// reloadHandler services /_jkl/reload, streaming a "reload" SSE event to
+// the browser each time the site is recompiled.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch := reloads.subscribe()
+	defer reloads.unsubscribe(ch)
+
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: reload\ndata: %d\n\n", time.Now().UnixNano())
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// bufferedResponse buffers a handler's response so liveReloadHandler can
+// inspect (and, for HTML, rewrite) the body before it reaches the client.
+type bufferedResponse struct {
+	http.ResponseWriter
+	buf    bytes.Buffer
+	status int
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+// liveReloadHandler wraps h and injects liveReloadScript into any
+// text/html response just before the closing </body> tag. Responses of
+// other content types are passed through untouched.
+func liveReloadHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &bufferedResponse{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+
+		body := rec.buf.Bytes()
+		if strings.Contains(rec.Header().Get("Content-Type"), "text/html") {
+			injected := bytes.Replace(body, []byte("</body>"), []byte(liveReloadScript+"</body>"), 1)
+			if !bytes.Equal(injected, body) {
+				body = injected
+				// The wrapped handler (e.g. http.ServeFile) already set
+				// Content-Length from the original body size; now that
+				// the injected script changed its length, that header
+				// would promise the client the wrong number of bytes.
+				// Only recompute it here, where the body actually
+				// changed - a HEAD request never reaches this branch
+				// with a rewritten body (there's no </body> in an empty
+				// one), so its correct Content-Length is left alone.
+				rec.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+		}
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		w.WriteHeader(rec.status)
+		w.Write(body)
+	})
+}
+
 func main() {
 
 	// Parse the input parameters
@@ -64,16 +200,21 @@ func main() {
 	os.Chdir(src)
 
 	// Initialize the jkl website
-	site, err := NewSite(src, dest)
+	site, err := NewSite(src, dest, *env)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	site.Jobs = *jobs
+	site.Force = *force
 
 	// Set any site variables that were overriden / provided in the cli args
 	if *baseurl != "" || site.Conf.Get("baseurl") == nil {
 		site.Conf.Set("baseurl", *baseurl)
 	}
+	if *uglyurls {
+		site.Conf.Set("uglyurls", true)
+	}
 
 	// Generate the static website
 	if err := site.Generate(); err != nil {
@@ -81,25 +222,10 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Deploys the static website to S3
-	if *deploy {
-
-		var conf *DeployConfig
-		// Read the S3 configuration details if not provided as
-		// command line
-		if *s3key == "" {
-			path := filepath.Join(site.Src, "_jkl_s3.yml")
-			conf, err = ParseDeployConfig(path)
-			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
-		} else {
-			// else use the command line args
-			conf = &DeployConfig{*s3key, *s3secret, *s3bucket}
-		}
-
-		if err := site.Deploy(conf.Key, conf.Secret, conf.Bucket); err != nil {
+	// Deploys the static website using the configured Deployer, if a
+	// target was given on the command line or in the deploy: config block
+	if *deployTo != "" || site.Conf.Get("deploy") != nil {
+		if err := site.Deploy(context.Background(), *deployTo); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -134,7 +260,16 @@ func main() {
 			path = filepath.Join(dest, path)
 			http.ServeFile(w, r, path)
 		}
-		http.HandleFunc("/", handler)
+
+		// In -auto mode, wrap the handler so served HTML pages get the
+		// live-reload snippet injected, and expose the SSE endpoint it
+		// connects to.
+		if *auto {
+			http.HandleFunc("/_jkl/reload", reloadHandler)
+			http.Handle("/", liveReloadHandler(http.HandlerFunc(handler)))
+		} else {
+			http.HandleFunc("/", handler)
+		}
 
 		// Serve the website from the _site directory
 		fmt.Printf("Starting server on port %s\n", *port)
@@ -191,6 +326,8 @@ func recompile(site *Site) {
 		fmt.Println(err)
 		return
 	}
+
+	reloads.broadcast()
 }
 
 func logf(msg string, args ...interface{}) {
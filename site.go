@@ -2,18 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
-	"mime"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
 
 	"github.com/gorilla/feeds"
-	"launchpad.net/goamz/aws"
-	"launchpad.net/goamz/s3"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
@@ -23,31 +24,41 @@ var (
 	MsgIgnoreDir    = "Ignoring Destination Directory: %s"
 	MsgIgnoreFile   = "Ignoring Destination File: %s"
 	MsgGenerateFile = "Generating Page: %s"
+	MsgSkipFile     = "Unchanged, Skipping: %s"
+	MsgRemoveFile   = "Removing Stale Output: %s"
 	MsgGenerateFeed = "Generating Feed: %s"
 	MsgUploadFile   = "Uploading: %s"
 	MsgUsingConfig  = "Loading Config: %s"
 )
 
 type Site struct {
-	Src  string // Directory where Jekyll will look to transform files
-	Dest string // Directory where Jekyll will write the site files
-	Conf Config // Configuration date from the _config.yml file
+	Src   string // Directory where Jekyll will look to transform files
+	Dest  string // Directory where Jekyll will write the site files
+	Conf  Config // Configuration date from the _config.yml file
+	Jobs  int    // Number of pages/files rendered or uploaded concurrently
+	Force bool   // If true, ignore the build cache and rewrite everything
 
 	posts []Page             // Posts that need to be generated
 	pages []Page             // Pages that need to be generated
 	files []string           // Static files to get copied to the destination
 	templ *template.Template // Compiled templates
 
+	layoutPaths  map[string]string   // layout/include template name -> source file
+	templateRefs map[string][]string // template name -> templates it references
+
+	sourceModTime map[string]time.Time // page/post URL -> source file mtime, for sitemap lastmod
+
+	cache *buildCache // tracks source hashes across builds for incremental generation
+
 	ignore []string // List of file/directory prefixes that will be ignored
 	// (not deleted) in the destination directory (eg .git)
 }
 
-func NewSite(src, dest string) (*Site, error) {
+func NewSite(src, dest, env string) (*Site, error) {
 
-	// Parse the _config.yaml file
-	path := filepath.Join(src, "_config.yaml")
-	conf, err := ParseConfig(path)
-	logf(MsgUsingConfig, path)
+	// Load _config.yaml (and, if env is set, _config.<env>.yaml over it),
+	// layered with JKL_* environment variables and built-in defaults.
+	conf, err := LoadConfig(src, env)
 	if err != nil {
 		return nil, err
 	}
@@ -61,12 +72,14 @@ func NewSite(src, dest string) (*Site, error) {
 		Src:    src,
 		Dest:   dest,
 		Conf:   conf,
+		Jobs:   runtime.NumCPU(),
+		cache:  loadBuildCache(src),
 		ignore: []string{},
 	}
 
 	// Create the list of prefixes to ignore in the destination
 	// directory.
-	site.ignore = conf.GetStrings("destignore")
+	site.ignore = conf.GetStringSlice("destignore")
 
 	// Recursively process all files in the source directory
 	// and parse pages, posts, templates, etc
@@ -145,10 +158,28 @@ func (s *Site) matchIgnore(rel string) bool {
 }
 
 // Generate  a static website based on Jekyll standard layout.
+//
+// Unless Force is set, Generate builds incrementally: a page or post is
+// only rewritten if its own content or layout, a layout/include it
+// depends on, or the set of post URLs (which any page could reference
+// through site.posts) changed since the last build, and a static file
+// only if its content changed or its output is missing. No other
+// site-level input is tracked: a change to _config.yaml alone, or to a
+// post's content as seen by other pages through site.posts, does not
+// rewrite pages whose own inputs are unchanged. Either way, once writing
+// is done, any
+// output recorded against a page, post, or static file that no longer
+// exists (renamed or deleted source) is deleted too, so a stale file
+// can't linger in the destination - or get picked up by Deploy - just
+// because -force wasn't passed. -force (or a first build, since there's
+// nothing to compare against yet) additionally falls back to a full
+// rebuild of every output.
 func (s *Site) Generate() error {
-	// Remove previously generated site files while preserving
-	// ignore files
-	if err := s.prep(); err != nil {
+	if s.Force {
+		if err := s.prep(); err != nil {
+			return err
+		}
+	} else if err := os.MkdirAll(s.Dest, 0755); err != nil {
 		return err
 	}
 
@@ -160,41 +191,30 @@ func (s *Site) Generate() error {
 		return err
 	}
 
-	return nil
-}
-
-// Deploys a site to S3.
-func (s *Site) Deploy(user, pass, url string) error {
-
-	auth := aws.Auth{AccessKey: user, SecretKey: pass}
-	b := s3.New(auth, aws.USEast).Bucket(url)
-
-	// walks _site directory and uploads file to S3
-	walker := func(fn string, fi os.FileInfo, err error) error {
-		if fi.IsDir() {
-			return nil
-		}
-
-		rel, _ := filepath.Rel(s.Dest, fn)
-		typ := mime.TypeByExtension(filepath.Ext(rel))
-		content, err := ioutil.ReadFile(fn)
-		logf(MsgUploadFile, rel)
-		if err != nil {
+	if s.cache != nil {
+		if err := s.cache.pruneStale(s.Dest); err != nil {
 			return err
 		}
+	}
 
-		// try to upload the file ... sometimes this fails due to amazon
-		// issues. If so, we'll re-try
-		if err := b.Put(rel, content, typ, s3.PublicRead); err != nil {
-			time.Sleep(100 * time.Millisecond) // sleep so that we don't immediately retry
-			return b.Put(rel, content, typ, s3.PublicRead)
-		}
+	if err := s.writeSitemap(); err != nil {
+		return err
+	}
 
-		// file upload was a success, return nil
-		return nil
+	if s.cache != nil {
+		return s.cache.save()
 	}
+	return nil
+}
 
-	return filepath.Walk(s.Dest, walker)
+// Deploy publishes the generated site using the Deployer selected by
+// name, or by the deploy: block in the site config if name is empty.
+func (s *Site) Deploy(ctx context.Context, name string) error {
+	d, err := NewDeployer(s.Conf, name, s.jobs())
+	if err != nil {
+		return err
+	}
+	return d.Deploy(ctx, s.Dest)
 }
 
 // Helper function to traverse the source directory and identify all posts,
@@ -205,6 +225,8 @@ func (s *Site) read() error {
 	// will need to be compiled
 	layouts := []string{}
 
+	s.sourceModTime = map[string]time.Time{}
+
 	// func to walk the jekyll directory structure
 	walker := func(fn string, fi os.FileInfo, err error) error {
 		rel, _ := filepath.Rel(s.Src, fn)
@@ -242,6 +264,7 @@ func (s *Site) read() error {
 			if err != nil {
 				return err
 			}
+			s.sourceModTime[post.GetUrl()] = fi.ModTime()
 			// TODO: this is a hack to get the posts in rev chronological order
 			s.posts = append([]Page{post}, s.posts...) //s.posts, post)
 
@@ -252,6 +275,7 @@ func (s *Site) read() error {
 			if err != nil {
 				return err
 			}
+			s.sourceModTime[page.GetUrl()] = fi.ModTime()
 			s.pages = append(s.pages, page)
 
 		// Move static files, no processing required
@@ -276,6 +300,15 @@ func (s *Site) read() error {
 		}
 	}
 
+	// Record where each layout/include template came from, and how they
+	// reference one another, so writePages can tell whether a page's
+	// rendered output depends on a layout that changed.
+	s.layoutPaths = map[string]string{}
+	for _, fn := range layouts {
+		s.layoutPaths[filepath.Base(fn)] = fn
+	}
+	s.templateRefs = templateRefs(s.templ)
+
 	// Add the posts, timestamp, etc to the Site Params
 	s.Conf.Set("posts", s.posts)
 	s.Conf.Set("time", time.Now())
@@ -286,7 +319,8 @@ func (s *Site) read() error {
 }
 
 // Helper function to write all pages and posts to the destination directory
-// during site generation.
+// during site generation. Pages are rendered concurrently across a pool of
+// s.Jobs workers.
 func (s *Site) writePages() error {
 
 	// Set up feed.
@@ -307,26 +341,274 @@ func (s *Site) writePages() error {
 	pages = append(pages, s.pages...)
 	pages = append(pages, s.posts...)
 
-	for _, page := range pages {
-		url := page.GetUrl()
+	// Resolve the output path for every page up front so we can catch two
+	// sources rendering to the same path before writing anything.
+	work := make([]pageWrite, len(pages))
+	seen := map[string]string{}
+	for i, page := range pages {
+		url := s.outputURL(page)
+		if src, ok := seen[url]; ok {
+			return fmt.Errorf("output collision: %s and %s both render to %s", src, page.GetUrl(), url)
+		}
+		seen[url] = page.GetUrl()
+		work[i] = pageWrite{page: page, url: url}
+	}
+
+	// Figure out, once per build, which layouts/includes changed and
+	// whether the post list itself changed; every page's dirty check
+	// below consults these instead of re-hashing layouts per page.
+	layoutsChanged := s.changedLayouts()
+	postsChanged := s.changedPosts()
+
+	jobs := s.jobs()
+	queue := make(chan pageWrite)
+	items := make(chan *feeds.Item, len(pages))
+
+	g, ctx := errgroup.WithContext(context.Background())
+	for i := 0; i < jobs; i++ {
+		// text/template.Template is safe for concurrent Execute but not
+		// concurrent Parse, and writePage parses each page's own content
+		// into the template set. So every worker gets its own Clone of
+		// s.templ up front, and only the main goroutine ever touches
+		// s.templ itself.
+		templ := s.templ
+		if templ != nil {
+			clone, err := templ.Clone()
+			if err != nil {
+				return err
+			}
+			templ = clone
+		}
+
+		g.Go(func() error {
+			for {
+				select {
+				case pw, ok := <-queue:
+					if !ok {
+						return nil
+					}
+					item, err := s.writePage(templ, pw, layoutsChanged, postsChanged)
+					if err != nil {
+						return err
+					}
+					if item != nil {
+						items <- item
+					}
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		})
+	}
+
+	go func() {
+		defer close(queue)
+		for _, pw := range work {
+			select {
+			case queue <- pw:
+			case <-ctx.Done():
+				// A worker hit an error and the errgroup's context was
+				// canceled; every worker is exiting via its own
+				// ctx.Done() case, so nothing will drain the rest of
+				// work. Stop feeding instead of blocking forever.
+				return
+			}
+		}
+	}()
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	close(items)
+
+	for item := range items {
+		feed.Add(item)
+	}
+
+	// Write feed to atom.xml.
+	atom, err := feed.ToAtom()
+	if err != nil {
+		return err
+	}
+	feedPath := "atom.xml"
+	if err := ioutil.WriteFile(filepath.Join(s.Dest, feedPath), []byte(atom), 0644); err != nil {
+		return err
+	}
+	logf(MsgGenerateFeed, feedPath)
+
+	return nil
+}
+
+// pageWrite pairs a Page with the output path it resolved to, so that
+// path can be computed (and checked for collisions) once, up front,
+// rather than recomputed by whichever worker happens to pick it up.
+type pageWrite struct {
+	page Page
+	url  string
+}
+
+// outputURL returns the path, relative to the destination root, that page
+// should be written to. By default jkl uses pretty URLs: a source like
+// about.md is written to about/index.html. Setting the uglyurls config
+// key (or the -uglyurls flag) restores the old about.html behavior.
+func (s *Site) outputURL(page Page) string {
+	url := page.GetUrl()
+
+	if strings.HasSuffix(url, "/") {
+		return url + "index.html"
+	}
+
+	if s.Conf.GetBool("uglyurls") {
+		return url
+	}
+
+	if strings.HasSuffix(url, ".html") && filepath.Base(url) != "index.html" {
+		return strings.TrimSuffix(url, filepath.Ext(url)) + "/index.html"
+	}
+
+	return url
+}
 
-		if strings.HasSuffix(url, "/") {
-			url += "index.html"
+// pageURL returns the URL a browser would request to reach page once the
+// site is written, e.g. "/about/" rather than the "about/index.html" file
+// outputURL writes it to. Templates and the sitemap both use this instead
+// of page.GetUrl() so that what they report agrees with what's actually on
+// disk.
+func (s *Site) pageURL(page Page) string {
+	return publicURL(s.outputURL(page))
+}
+
+// publicURL strips the implicit index.html from an outputURL path to get
+// the URL a browser would actually request, leaving ugly (non-index.html)
+// paths alone.
+func publicURL(out string) string {
+	switch {
+	case out == "index.html" || out == "/index.html":
+		return "/"
+	case strings.HasSuffix(out, "/index.html"):
+		return strings.TrimSuffix(out, "index.html")
+	case strings.HasPrefix(out, "/"):
+		return out
+	default:
+		return "/" + out
+	}
+}
+
+// pageView wraps a Page so templates see the URL it was actually written
+// to (pageURL's pretty form) instead of the raw one Page.GetUrl() reports,
+// without requiring a change to Page itself.
+type pageView struct {
+	Page
+	url string
+}
+
+func (p *pageView) GetUrl() string { return p.url }
+
+// changedLayouts hashes every known layout/include against the cache from
+// the last build, recording the fresh hash either way, and returns which
+// template names changed.
+func (s *Site) changedLayouts() map[string]bool {
+	changed := map[string]bool{}
+	for name, path := range s.layoutPaths {
+		key := "layout:" + name
+		hash, err := hashFile(path)
+		if err != nil {
+			changed[name] = true
+			continue
+		}
+		if s.Force || s.cache == nil || s.cache.hash(key) != hash {
+			changed[name] = true
 		}
+		if s.cache != nil {
+			s.cache.record(key, hash, nil)
+		}
+	}
+	return changed
+}
+
+// changedPosts reports whether the set of posts (by URL) differs from the
+// last build, recording the fresh fingerprint either way. Any page could
+// reference site.posts/site.tags/site.categories in its template, so a
+// change here is treated as a reason to re-render every page, not just
+// posts.
+func (s *Site) changedPosts() bool {
+	ids := make([]string, len(s.posts))
+	for i, post := range s.posts {
+		ids[i] = post.GetUrl()
+	}
+	sort.Strings(ids)
+	fingerprint := hashString(strings.Join(ids, "\x00"))
+
+	const key = "site:posts"
+	changed := s.Force || s.cache == nil || s.cache.hash(key) != fingerprint
+	if s.cache != nil {
+		s.cache.record(key, fingerprint, nil)
+	}
+	return changed
+}
+
+// layoutTreeChanged reports whether layout (a page's raw, un-extensioned
+// layout front-matter value) or anything it transitively templates/blocks
+// in was among the layouts changedLayouts found dirty.
+func (s *Site) layoutTreeChanged(layout string, changed map[string]bool) bool {
+	if layout == "" || layout == "nil" {
+		return false
+	}
 
-		layout := page.GetLayout()
+	name := appendExt(layout, ".html")
+	if changed[name] {
+		return true
+	}
+	for _, dep := range transitiveTemplateRefs(s.templateRefs, name) {
+		if changed[dep] {
+			return true
+		}
+	}
+	return false
+}
 
+// writePage renders a single page using templ (a per-worker clone of
+// s.templ) and writes it to the destination directory, unless the cache
+// says neither the page, its layout tree, nor the post list changed since
+// the last build. If the page is a post (has a date), the feed item to
+// add for it is returned regardless, since atom.xml always lists every
+// post.
+func (s *Site) writePage(templ *template.Template, pw pageWrite, layoutsChanged map[string]bool, postsChanged bool) (*feeds.Item, error) {
+	page := pw.page
+	url := pw.url
+
+	layout := page.GetLayout()
+
+	cacheKey := "page:" + url
+	srcHash := hashString(page.GetContent() + "\x00" + layout)
+
+	dirty := s.Force || s.cache == nil ||
+		s.cache.hash(cacheKey) != srcHash ||
+		s.layoutTreeChanged(layout, layoutsChanged) ||
+		postsChanged
+
+	if !dirty {
+		logf(MsgSkipFile, url)
+		// Still mark this key as seen even though nothing was rewritten,
+		// so pruneStale doesn't mistake an unchanged page for one whose
+		// source was renamed or removed.
+		if s.cache != nil {
+			s.cache.record(cacheKey, srcHash, []string{url})
+		}
+	} else {
 		// Make sure the posts's parent dir exists
 		d := filepath.Join(s.Dest, filepath.Dir(url))
 		f := filepath.Join(s.Dest, url)
 		if err := os.MkdirAll(d, 0755); err != nil {
-			return err
+			return nil, err
 		}
 
-		// Data passed in to each template
+		// Data passed in to each template. page is wrapped so
+		// {{ .page.url }} reports the pretty URL this page is actually
+		// being written to, not page.GetUrl()'s raw form.
 		data := map[string]interface{}{
-			"site": s.Conf,
-			"page": page,
+			"site": s.Conf.Map(),
+			"page": &pageView{Page: page, url: publicURL(url)},
 		}
 
 		// Treat all non-markdown pages as templates
@@ -336,18 +618,18 @@ func (s *Site) writePages() error {
 			// will execute the template, and then set the content
 			// to the rendered template
 
-			if s.templ == nil {
-				return fmt.Errorf("No templates defined for page: %s", url)
+			if templ == nil {
+				return nil, fmt.Errorf("No templates defined for page: %s", url)
 			}
 
-			t, err := s.templ.New(url).Parse(content)
+			t, err := templ.New(url).Parse(content)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			var buf bytes.Buffer
 			err = t.ExecuteTemplate(&buf, url, data)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			content = buf.String()
 		}
@@ -360,67 +642,97 @@ func (s *Site) writePages() error {
 		//       content as if it were a template
 		var buf bytes.Buffer
 		if layout == "" || layout == "nil" {
-			//t, err := s.templ.New(url).Parse(content);
-			//if err != nil { return err }
-			//err = t.ExecuteTemplate(&buf, url, data);
-			//if err != nil { return err }
-
 			buf.WriteString(content)
 		} else {
-			layout = appendExt(layout, ".html")
-			s.templ.ExecuteTemplate(&buf, layout, data)
+			templ.ExecuteTemplate(&buf, appendExt(layout, ".html"), data)
 		}
 
 		logf(MsgGenerateFile, url)
 		if err := ioutil.WriteFile(f, buf.Bytes(), 0644); err != nil {
-			return err
+			return nil, err
 		}
 
-		// Append posts to the feed. Posts are any page with a date field.
-		var postTime time.Time
-		if date := page.Get("date"); date != nil {
-			postTime = date.(time.Time)
-		}
-		if !postTime.IsZero() {
-			feed.Add(&feeds.Item{
-				Title:       page.GetTitle(),
-				Link:        &feeds.Link{Href: page.GetUrl()},
-				Description: page.GetDescription(),
-				Author:      &feeds.Author{Name: page.GetString("author")},
-				Created:     postTime,
-			})
+		if s.cache != nil {
+			s.cache.record(cacheKey, srcHash, []string{url})
 		}
 	}
 
-	// Write feed to atom.xml.
-	atom, err := feed.ToAtom()
-	if err != nil {
-		return err
+	// Posts are any page with a date field; build its feed item.
+	var postTime time.Time
+	if date := page.Get("date"); date != nil {
+		postTime = date.(time.Time)
 	}
-	feedPath := "atom.xml"
-	if err := ioutil.WriteFile(filepath.Join(s.Dest, feedPath), []byte(atom), 0644); err != nil {
-		return err
+	if postTime.IsZero() {
+		return nil, nil
 	}
-	logf(MsgGenerateFeed, feedPath)
 
-	return nil
+	return &feeds.Item{
+		Title:       page.GetTitle(),
+		Link:        &feeds.Link{Href: publicURL(url)},
+		Description: page.GetDescription(),
+		Author:      &feeds.Author{Name: page.GetString("author")},
+		Created:     postTime,
+	}, nil
 }
 
 // Helper function to write all static files to the destination directory
-// during site generation. This will also take care of creating any parent
-// directories, if necessary.
+// during site generation, copying up to s.Jobs files concurrently. Files
+// whose hash matches the last build, and that are still present at the
+// destination, are left alone. This will also take care of creating any
+// parent directories, if necessary.
 func (s *Site) writeStatic() error {
 
+	g := new(errgroup.Group)
+	sem := make(chan struct{}, s.jobs())
+
 	for _, file := range s.files {
-		from := filepath.Join(s.Src, file)
-		to := filepath.Join(s.Dest, file)
-		logf(MsgCopyingFile, file)
-		if err := copyTo(from, to); err != nil {
-			return err
-		}
+		file := file
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			from := filepath.Join(s.Src, file)
+			to := filepath.Join(s.Dest, file)
+
+			hash, err := hashFile(from)
+			if err != nil {
+				return err
+			}
+
+			cacheKey := "static:" + file
+			if !s.Force && s.cache != nil && s.cache.hash(cacheKey) == hash {
+				if _, err := os.Stat(to); err == nil {
+					logf(MsgSkipFile, file)
+					// Still mark this key as seen even though nothing was
+					// copied, so pruneStale doesn't mistake an unchanged
+					// static file for one whose source was renamed or
+					// removed.
+					s.cache.record(cacheKey, hash, []string{file})
+					return nil
+				}
+			}
+
+			logf(MsgCopyingFile, file)
+			if err := copyTo(from, to); err != nil {
+				return err
+			}
+			if s.cache != nil {
+				s.cache.record(cacheKey, hash, []string{file})
+			}
+			return nil
+		})
 	}
 
-	return nil
+	return g.Wait()
+}
+
+// jobs returns the configured worker pool size, falling back to 1 if Jobs
+// was never set (e.g. a Site constructed outside of NewSite).
+func (s *Site) jobs() int {
+	if s.Jobs < 1 {
+		return 1
+	}
+	return s.Jobs
 }
 
 // Helper function to aggregate a list of all categories and their
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Limits from the sitemaps.org 0.9 protocol: a single sitemap file may
+// list at most 50,000 URLs and must not exceed 50MiB uncompressed.
+const (
+	sitemapMaxURLs = 50000
+	sitemapMaxSize = 50 * 1024 * 1024
+)
+
+type sitemapURL struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod,omitempty"`
+	ChangeFreq string `xml:"changefreq,omitempty"`
+	Priority   string `xml:"priority,omitempty"`
+}
+
+type sitemapUrlset struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndexEntry struct {
+	Loc string `xml:"loc"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name            `xml:"sitemapindex"`
+	Xmlns    string              `xml:"xmlns,attr"`
+	Sitemaps []sitemapIndexEntry `xml:"sitemap"`
+}
+
+// writeSitemap emits a sitemap.xml at the destination root, one <url> per
+// generated page or post, skipping any with a `sitemap: false` front-matter
+// key. If the site is large enough to exceed the sitemaps.org limits, the
+// URLs are split across sitemap-N.xml files referenced from a
+// sitemap_index.xml instead. It also writes a robots.txt that points at
+// whichever of the two was produced.
+func (s *Site) writeSitemap() error {
+
+	baseurl := strings.TrimRight(s.Conf.GetString("baseurl"), "/")
+
+	pages := []Page{}
+	pages = append(pages, s.pages...)
+	pages = append(pages, s.posts...)
+
+	urls := make([]sitemapURL, 0, len(pages))
+	for _, page := range pages {
+		if v := page.Get("sitemap"); v != nil {
+			if enabled, ok := v.(bool); ok && !enabled {
+				continue
+			}
+		}
+
+		// Prefer the post's own date; otherwise fall back to the source
+		// file's mtime, so lastmod only changes when the file actually
+		// does rather than on every build.
+		lastmod := s.sourceModTime[page.GetUrl()]
+		if date := page.Get("date"); date != nil {
+			lastmod = date.(time.Time)
+		}
+
+		u := sitemapURL{
+			Loc:     baseurl + s.pageURL(page),
+			LastMod: lastmod.Format(time.RFC3339),
+		}
+		if freq, ok := page.Get("changefreq").(string); ok {
+			u.ChangeFreq = freq
+		}
+		if pri := page.Get("priority"); pri != nil {
+			u.Priority = fmt.Sprintf("%v", pri)
+		}
+		urls = append(urls, u)
+	}
+
+	paths, err := s.writeSitemapFiles(urls)
+	if err != nil {
+		return err
+	}
+
+	return s.writeRobots(paths)
+}
+
+// writeSitemapFiles writes urls to sitemap.xml, or, if they don't fit in a
+// single file, to sitemap-N.xml files plus a sitemap_index.xml. It returns
+// the path(s), relative to the destination root, that robots.txt should
+// reference.
+func (s *Site) writeSitemapFiles(urls []sitemapURL) ([]string, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	chunks := chunkSitemapURLs(urls, sitemapMaxURLs, sitemapMaxSize)
+
+	if len(chunks) == 1 {
+		path := "sitemap.xml"
+		if err := writeSitemapFile(filepath.Join(s.Dest, path), chunks[0]); err != nil {
+			return nil, err
+		}
+		logf(MsgGenerateFile, path)
+		return []string{path}, nil
+	}
+
+	paths := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		path := fmt.Sprintf("sitemap-%d.xml", i+1)
+		if err := writeSitemapFile(filepath.Join(s.Dest, path), chunk); err != nil {
+			return nil, err
+		}
+		logf(MsgGenerateFile, path)
+		paths[i] = path
+	}
+
+	if err := s.writeSitemapIndex(paths); err != nil {
+		return nil, err
+	}
+	return []string{"sitemap_index.xml"}, nil
+}
+
+// chunkSitemapURLs splits urls into groups of at most maxCount entries
+// whose marshaled size stays under maxBytes. The byte count is the sum of
+// each <url> element's size as writeSitemapFile indents it, an
+// approximation that ignores the surrounding <urlset> envelope, which is
+// negligible in comparison.
+func chunkSitemapURLs(urls []sitemapURL, maxCount, maxBytes int) [][]sitemapURL {
+	var chunks [][]sitemapURL
+	var cur []sitemapURL
+	curBytes := 0
+
+	for _, u := range urls {
+		var b bytes.Buffer
+		enc := xml.NewEncoder(&b)
+		enc.Indent("  ", "  ")
+		enc.EncodeElement(u, xml.StartElement{Name: xml.Name{Local: "url"}})
+		// +1 for the newline that precedes each <url> in the written file.
+		size := b.Len() + 1
+
+		if len(cur) >= maxCount || curBytes+size > maxBytes {
+			if len(cur) > 0 {
+				chunks = append(chunks, cur)
+			}
+			cur = nil
+			curBytes = 0
+		}
+
+		cur = append(cur, u)
+		curBytes += size
+	}
+	if len(cur) > 0 {
+		chunks = append(chunks, cur)
+	}
+	return chunks
+}
+
+func writeSitemapFile(path string, urls []sitemapURL) error {
+	set := sitemapUrlset{
+		Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9",
+		URLs:  urls,
+	}
+	data, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (s *Site) writeSitemapIndex(paths []string) error {
+	baseurl := strings.TrimRight(s.Conf.GetString("baseurl"), "/")
+
+	entries := make([]sitemapIndexEntry, len(paths))
+	for i, p := range paths {
+		entries[i] = sitemapIndexEntry{Loc: baseurl + "/" + p}
+	}
+
+	index := sitemapIndex{
+		Xmlns:    "http://www.sitemaps.org/schemas/sitemap/0.9",
+		Sitemaps: entries,
+	}
+	data, err := xml.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+
+	path := "sitemap_index.xml"
+	logf(MsgGenerateFile, path)
+	return ioutil.WriteFile(filepath.Join(s.Dest, path), data, 0644)
+}
+
+// writeRobots emits a robots.txt at the destination root. When baseurl is
+// set, it points crawlers at the sitemap(s) written by writeSitemap.
+func (s *Site) writeRobots(sitemapPaths []string) error {
+	var buf bytes.Buffer
+	buf.WriteString("User-agent: *\nAllow: /\n")
+
+	baseurl := strings.TrimRight(s.Conf.GetString("baseurl"), "/")
+	if baseurl != "" {
+		for _, p := range sitemapPaths {
+			fmt.Fprintf(&buf, "Sitemap: %s/%s\n", baseurl, p)
+		}
+	}
+
+	path := "robots.txt"
+	logf(MsgGenerateFile, path)
+	return ioutil.WriteFile(filepath.Join(s.Dest, path), buf.Bytes(), 0644)
+}